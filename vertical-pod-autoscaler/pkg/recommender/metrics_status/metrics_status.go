@@ -0,0 +1,139 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics_status exposes Prometheus gauges describing the current
+// recommendation and condition state of every VPA object seen by the
+// recommender, independently of whether a given reconcile resulted in a
+// write to the API server.
+package metrics_status
+
+import (
+	core "k8s.io/api/core/v1"
+
+	vpa_types "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1beta2"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/utils/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = metrics.TopMetricsNamespace + "recommender"
+
+var (
+	recommendationTarget = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "recommendation_target",
+			Help:      "Target recommendation for a VPA container, per resource.",
+		}, []string{"namespace", "vpa", "container", "resource"},
+	)
+	recommendationLowerBound = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "recommendation_lower_bound",
+			Help:      "Lower bound recommendation for a VPA container, per resource.",
+		}, []string{"namespace", "vpa", "container", "resource"},
+	)
+	recommendationUpperBound = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "recommendation_upper_bound",
+			Help:      "Upper bound recommendation for a VPA container, per resource.",
+		}, []string{"namespace", "vpa", "container", "resource"},
+	)
+	recommendationUncappedTarget = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "recommendation_uncapped_target",
+			Help:      "Target recommendation before applying container policy caps, per resource.",
+		}, []string{"namespace", "vpa", "container", "resource"},
+	)
+	condition = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "condition",
+			Help:      "Whether a given condition is currently true (1) or false (0) for a VPA.",
+		}, []string{"namespace", "vpa", "type"},
+	)
+	containerMinAllowed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "spec_container_minallowed",
+			Help:      "Minimum allowed resources for a VPA container, as resolved from its container policy.",
+		}, []string{"namespace", "vpa", "container", "resource"},
+	)
+	containerMaxAllowed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "spec_container_maxallowed",
+			Help:      "Maximum allowed resources for a VPA container, as resolved from its container policy.",
+		}, []string{"namespace", "vpa", "container", "resource"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(recommendationTarget)
+	prometheus.MustRegister(recommendationLowerBound)
+	prometheus.MustRegister(recommendationUpperBound)
+	prometheus.MustRegister(recommendationUncappedTarget)
+	prometheus.MustRegister(condition)
+	prometheus.MustRegister(containerMinAllowed)
+	prometheus.MustRegister(containerMaxAllowed)
+}
+
+func setResourceList(gauge *prometheus.GaugeVec, namespace, vpaName, container string, resources core.ResourceList) {
+	for resourceName, quantity := range resources {
+		gauge.WithLabelValues(namespace, vpaName, container, resourceName.String()).Set(quantity.AsApproximateFloat64())
+	}
+}
+
+// ObserveVpaStatus updates the recommendation and condition gauges for a
+// single VPA to reflect the status the recommender is about to (or has just
+// decided not to) write.
+func ObserveVpaStatus(namespace, vpaName string, status *vpa_types.VerticalPodAutoscalerStatus) {
+	if status == nil {
+		return
+	}
+	if status.Recommendation != nil {
+		for _, cr := range status.Recommendation.ContainerRecommendations {
+			setResourceList(recommendationTarget, namespace, vpaName, cr.ContainerName, cr.Target)
+			setResourceList(recommendationLowerBound, namespace, vpaName, cr.ContainerName, cr.LowerBound)
+			setResourceList(recommendationUpperBound, namespace, vpaName, cr.ContainerName, cr.UpperBound)
+			setResourceList(recommendationUncappedTarget, namespace, vpaName, cr.ContainerName, cr.UncappedTarget)
+		}
+	}
+	for _, cond := range status.Conditions {
+		value := 0.0
+		if cond.Status == core.ConditionTrue {
+			value = 1.0
+		}
+		condition.WithLabelValues(namespace, vpaName, string(cond.Type)).Set(value)
+	}
+}
+
+// ObserveContainerPolicies updates the per-container min/max allowed gauges
+// from whatever policy getPolicy returns for each container; any wildcard
+// ("*") resolution is up to getPolicy. Containers for which getPolicy returns
+// nil are skipped.
+func ObserveContainerPolicies(namespace, vpaName string, containerNames []string, getPolicy func(string) *vpa_types.ContainerResourcePolicy) {
+	for _, containerName := range containerNames {
+		containerPolicy := getPolicy(containerName)
+		if containerPolicy == nil {
+			continue
+		}
+		setResourceList(containerMinAllowed, namespace, vpaName, containerName, containerPolicy.MinAllowed)
+		setResourceList(containerMaxAllowed, namespace, vpaName, containerName, containerPolicy.MaxAllowed)
+	}
+}
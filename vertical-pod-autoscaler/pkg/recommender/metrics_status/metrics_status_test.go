@@ -0,0 +1,58 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics_status
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	vpa_types "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1beta2"
+)
+
+func TestObserveContainerPolicies(t *testing.T) {
+	namedPolicy := &vpa_types.ContainerResourcePolicy{
+		ContainerName: "container1",
+		MinAllowed:    core.ResourceList{core.ResourceCPU: *resource.NewScaledQuantity(1, 0)},
+		MaxAllowed:    core.ResourceList{core.ResourceCPU: *resource.NewScaledQuantity(4, 0)},
+	}
+	wildcardPolicy := &vpa_types.ContainerResourcePolicy{
+		ContainerName: "container2",
+		MinAllowed:    core.ResourceList{core.ResourceMemory: *resource.NewScaledQuantity(100, 6)},
+		MaxAllowed:    core.ResourceList{core.ResourceMemory: *resource.NewScaledQuantity(500, 6)},
+	}
+
+	getPolicy := func(containerName string) *vpa_types.ContainerResourcePolicy {
+		switch containerName {
+		case "container1":
+			return namedPolicy
+		case "container2":
+			return wildcardPolicy // resolved from the "*" policy by the caller
+		}
+		return nil
+	}
+
+	ObserveContainerPolicies("test", "vpa", []string{"container1", "container2"}, getPolicy)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(containerMinAllowed.WithLabelValues("test", "vpa", "container1", "cpu")))
+	assert.Equal(t, float64(4), testutil.ToFloat64(containerMaxAllowed.WithLabelValues("test", "vpa", "container1", "cpu")))
+	assert.Equal(t, float64(100e6), testutil.ToFloat64(containerMinAllowed.WithLabelValues("test", "vpa", "container2", "memory")))
+	assert.Equal(t, float64(500e6), testutil.ToFloat64(containerMaxAllowed.WithLabelValues("test", "vpa", "container2", "memory")))
+}
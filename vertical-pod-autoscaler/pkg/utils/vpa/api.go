@@ -0,0 +1,529 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"k8s.io/klog/v2"
+
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+
+	vpa_types "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1beta2"
+	vpa_api "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/client/clientset/versioned/typed/autoscaling.k8s.io/v1beta2"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/recommender/metrics_status"
+	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/recommender/model"
+)
+
+// VpaWithSelector is a pair of VPA and its selector.
+type VpaWithSelector struct {
+	Vpa      *vpa_types.VerticalPodAutoscaler
+	Selector labels.Selector
+}
+
+// PodMatchesVPA returns true if given pod is covered by a given VPA.
+func PodMatchesVPA(pod *core.Pod, vpaWithSelector *VpaWithSelector) bool {
+	if pod.Namespace != vpaWithSelector.Vpa.Namespace {
+		return false
+	}
+	return vpaWithSelector.Selector.Matches(labels.Set(pod.Labels))
+}
+
+// ControllerRef identifies a single workload controller in a pod's
+// ownership chain.
+type ControllerRef struct {
+	GroupKind schema.GroupKind
+	Name      string
+}
+
+// OwnerResolver resolves the chain of workload controllers owning a given
+// pod (e.g. a ReplicaSet and the Deployment that owns it), ordered from the
+// pod's most immediate controller to its ultimate root. Implementations are
+// expected to be backed by cached informers, since this is called on every
+// VPA/pod match.
+type OwnerResolver interface {
+	// GetOwnerChain returns the pod's owning controllers, starting with its
+	// most immediate owner (index 0) and ending with the root workload
+	// (e.g. a Deployment/StatefulSet/DaemonSet/Rollout/CronJob). Returns nil
+	// if no owner could be resolved.
+	GetOwnerChain(pod *core.Pod) []ControllerRef
+}
+
+// targetRefMatch returns whether the VPA's targetRef matches any controller
+// in the pod's resolved ownership chain, and if so, how close to the root
+// that match is: 0 for the pod's most immediate controller, increasing for
+// each level further up the chain towards the root.
+func targetRefMatch(vpa *vpa_types.VerticalPodAutoscaler, pod *core.Pod, resolver OwnerResolver) (matched bool, depth int) {
+	if resolver == nil || vpa.Spec.TargetRef == nil {
+		return false, 0
+	}
+	gv, err := schema.ParseGroupVersion(vpa.Spec.TargetRef.APIVersion)
+	if err != nil {
+		return false, 0
+	}
+	targetGK := schema.GroupKind{Group: gv.Group, Kind: vpa.Spec.TargetRef.Kind}
+	for i, owner := range resolver.GetOwnerChain(pod) {
+		if owner.GroupKind == targetGK && owner.Name == vpa.Spec.TargetRef.Name {
+			return true, i
+		}
+	}
+	return false, 0
+}
+
+// stronger returns true if vpa is a better fit for pod than otherVpa. A VPA
+// whose targetRef matches a controller in the pod's resolved ownership chain
+// always wins over one that doesn't; among VPAs that both match, the one
+// matching the root workload (e.g. the Deployment/StatefulSet at the top of
+// the chain, as real VPAs are meant to target) wins over one matching an
+// intermediate controller closer to the pod; remaining ties fall back to
+// whichever VPA was created first.
+func stronger(pod *core.Pod, resolver OwnerResolver, vpa, otherVpa *vpa_types.VerticalPodAutoscaler) bool {
+	if otherVpa == nil {
+		return true
+	}
+	vpaMatched, vpaDepth := targetRefMatch(vpa, pod, resolver)
+	otherMatched, otherDepth := targetRefMatch(otherVpa, pod, resolver)
+	if vpaMatched != otherMatched {
+		return vpaMatched
+	}
+	if vpaMatched && vpaDepth != otherDepth {
+		return vpaDepth > otherDepth
+	}
+	ts := vpa.CreationTimestamp
+	otherTs := otherVpa.CreationTimestamp
+	return ts.Before(&otherTs)
+}
+
+// GetControllingVPAForPod chooses the VPA from the given list whose selector
+// matches the given pod, preferring one whose targetRef matches a controller
+// in the pod's resolved ownership chain (the closer the matched controller is
+// to the root, the stronger the preference) and falling back to creation
+// timestamp to break ties. resolver may be nil, in which case only creation
+// timestamp is considered.
+func GetControllingVPAForPod(pod *core.Pod, vpas []*VpaWithSelector, resolver OwnerResolver) *VpaWithSelector {
+	var controlling *VpaWithSelector
+	var controllingVpa *vpa_types.VerticalPodAutoscaler
+	for _, vpaWithSelector := range vpas {
+		if PodMatchesVPA(pod, vpaWithSelector) {
+			currentVpa := vpaWithSelector.Vpa
+			if stronger(pod, resolver, currentVpa, controllingVpa) {
+				controlling = vpaWithSelector
+				controllingVpa = currentVpa
+			}
+		}
+	}
+	return controlling
+}
+
+// GetContainerResourcePolicy returns the ContainerResourcePolicy for a given
+// policy and container name. It returns the wildcard ("*") policy if there
+// is no policy specifically for the named container.
+func GetContainerResourcePolicy(containerName string, policy *vpa_types.PodResourcePolicy) *vpa_types.ContainerResourcePolicy {
+	var defaultPolicy *vpa_types.ContainerResourcePolicy
+	if policy != nil {
+		for i, containerPolicy := range policy.ContainerPolicies {
+			if containerPolicy.ContainerName == containerName {
+				return &policy.ContainerPolicies[i]
+			}
+			if containerPolicy.ContainerName == vpa_types.DefaultContainerResourcePolicy {
+				defaultPolicy = &policy.ContainerPolicies[i]
+			}
+		}
+	}
+	return defaultPolicy
+}
+
+// observeContainerPolicies updates the container minallowed/maxallowed
+// gauges for every container vpa currently recommends for, resolving each one
+// through ResolveEffectiveContainerPolicy so that containers covered only by
+// the wildcard ("*") policy, or whose named policy only sets some fields, are
+// reflected too.
+func observeContainerPolicies(vpa *model.Vpa) {
+	if vpa.Recommendation == nil {
+		return
+	}
+	containerNames := make([]string, 0, len(vpa.Recommendation.ContainerRecommendations))
+	for _, cr := range vpa.Recommendation.ContainerRecommendations {
+		containerNames = append(containerNames, cr.ContainerName)
+	}
+	metrics_status.ObserveContainerPolicies(vpa.ID.Namespace, vpa.ID.VpaName, containerNames,
+		func(containerName string) *vpa_types.ContainerResourcePolicy {
+			return ResolveEffectiveContainerPolicy(containerName, vpa.ResourcePolicy)
+		})
+}
+
+// lookupContainerPolicy returns the ContainerResourcePolicy exactly matching
+// containerName, or nil if policy carries no such entry. Unlike
+// GetContainerResourcePolicy it never falls back to the wildcard ("*") entry.
+func lookupContainerPolicy(containerName string, policy *vpa_types.PodResourcePolicy) *vpa_types.ContainerResourcePolicy {
+	if policy == nil {
+		return nil
+	}
+	for i, containerPolicy := range policy.ContainerPolicies {
+		if containerPolicy.ContainerName == containerName {
+			return &policy.ContainerPolicies[i]
+		}
+	}
+	return nil
+}
+
+func mergeResourceList(named, wildcard core.ResourceList) core.ResourceList {
+	if named == nil && wildcard == nil {
+		return nil
+	}
+	merged := core.ResourceList{}
+	for resourceName, quantity := range wildcard {
+		merged[resourceName] = quantity
+	}
+	for resourceName, quantity := range named {
+		merged[resourceName] = quantity
+	}
+	return merged
+}
+
+// ResolveEffectiveContainerPolicy returns the ContainerResourcePolicy that
+// applies to containerName, merging the named policy with the wildcard ("*")
+// policy when both are present: named-field values win on conflict, and
+// fields left unset on the named policy (MinAllowed/MaxAllowed per resource,
+// ControlledResources, ControlledValues, Mode) are inherited from the
+// wildcard. Falls back to whichever of the two is present if only one is,
+// and returns nil if neither applies.
+func ResolveEffectiveContainerPolicy(containerName string, policy *vpa_types.PodResourcePolicy) *vpa_types.ContainerResourcePolicy {
+	named := lookupContainerPolicy(containerName, policy)
+	wildcard := lookupContainerPolicy(vpa_types.DefaultContainerResourcePolicy, policy)
+
+	if wildcard == nil {
+		return named
+	}
+	if named == nil {
+		merged := *wildcard
+		merged.ContainerName = containerName
+		return &merged
+	}
+
+	merged := *named
+	merged.MinAllowed = mergeResourceList(named.MinAllowed, wildcard.MinAllowed)
+	merged.MaxAllowed = mergeResourceList(named.MaxAllowed, wildcard.MaxAllowed)
+	if merged.ControlledResources == nil {
+		merged.ControlledResources = wildcard.ControlledResources
+	}
+	if merged.ControlledValues == nil {
+		merged.ControlledValues = wildcard.ControlledValues
+	}
+	if merged.Mode == nil {
+		merged.Mode = wildcard.Mode
+	}
+	return &merged
+}
+
+// containerRecommendationUpToDate returns true if observed carries the same
+// Target/LowerBound/UpperBound/UncappedTarget as desired.
+func containerRecommendationUpToDate(desired, observed *vpa_types.RecommendedContainerResources) bool {
+	return reflect.DeepEqual(desired.Target, observed.Target) &&
+		reflect.DeepEqual(desired.LowerBound, observed.LowerBound) &&
+		reflect.DeepEqual(desired.UpperBound, observed.UpperBound) &&
+		reflect.DeepEqual(desired.UncappedTarget, observed.UncappedTarget)
+}
+
+// recommendationUpToDate returns true if every container recommendation in
+// desired has a matching entry in observed. Container recommendations present
+// in observed but absent from desired (e.g. sidecars the recommender no
+// longer tracks) are ignored.
+func recommendationUpToDate(desired, observed *vpa_types.RecommendedPodResources) bool {
+	if desired == nil {
+		return true
+	}
+	if observed == nil {
+		return len(desired.ContainerRecommendations) == 0
+	}
+	observedByContainer := make(map[string]vpa_types.RecommendedContainerResources, len(observed.ContainerRecommendations))
+	for _, cr := range observed.ContainerRecommendations {
+		observedByContainer[cr.ContainerName] = cr
+	}
+	for _, desiredCr := range desired.ContainerRecommendations {
+		observedCr, found := observedByContainer[desiredCr.ContainerName]
+		if !found || !containerRecommendationUpToDate(&desiredCr, &observedCr) {
+			return false
+		}
+	}
+	return true
+}
+
+// conditionsUpToDate returns true if every condition in desired has a
+// matching Type/Status/Reason/Message entry in observed. Conditions present
+// in observed but absent from desired are ignored.
+func conditionsUpToDate(desired, observed []vpa_types.VerticalPodAutoscalerCondition) bool {
+	observedByType := make(map[vpa_types.VerticalPodAutoscalerConditionType]vpa_types.VerticalPodAutoscalerCondition, len(observed))
+	for _, cond := range observed {
+		observedByType[cond.Type] = cond
+	}
+	for _, desiredCond := range desired {
+		observedCond, found := observedByType[desiredCond.Type]
+		if !found ||
+			observedCond.Status != desiredCond.Status ||
+			observedCond.Reason != desiredCond.Reason ||
+			observedCond.Message != desiredCond.Message {
+			return false
+		}
+	}
+	return true
+}
+
+// vpaStatusUpToDate returns true if observed is a superset of desired: every
+// container recommendation and condition desired carries is present in
+// observed with matching values, regardless of any extra entries observed
+// may carry (e.g. written by another controller sharing the object).
+func vpaStatusUpToDate(desired, observed *vpa_types.VerticalPodAutoscalerStatus) bool {
+	if observed == nil {
+		return desired == nil
+	}
+	return recommendationUpToDate(desired.Recommendation, observed.Recommendation) &&
+		conditionsUpToDate(desired.Conditions, observed.Conditions)
+}
+
+// fieldManager identifies the recommender as the writer of the status fields
+// it patches. Other controllers' conditions and container recommendations are
+// kept intact by mergeConditions and mergeRecommendations, not by the field
+// manager.
+const fieldManager = "vpa-recommender"
+
+// mergeConditions upserts every condition in desired into observed by Type,
+// preserving any condition in observed whose Type the recommender doesn't
+// own.
+func mergeConditions(desired, observed []vpa_types.VerticalPodAutoscalerCondition) []vpa_types.VerticalPodAutoscalerCondition {
+	merged := make([]vpa_types.VerticalPodAutoscalerCondition, 0, len(observed)+len(desired))
+	desiredByType := make(map[vpa_types.VerticalPodAutoscalerConditionType]vpa_types.VerticalPodAutoscalerCondition, len(desired))
+	for _, cond := range desired {
+		desiredByType[cond.Type] = cond
+	}
+	seen := make(map[vpa_types.VerticalPodAutoscalerConditionType]bool, len(desired))
+	for _, cond := range observed {
+		if desiredCond, owned := desiredByType[cond.Type]; owned {
+			merged = append(merged, desiredCond)
+			seen[cond.Type] = true
+		} else {
+			merged = append(merged, cond)
+		}
+	}
+	for _, cond := range desired {
+		if !seen[cond.Type] {
+			merged = append(merged, cond)
+		}
+	}
+	return merged
+}
+
+// mergeRecommendations upserts every container recommendation in desired into
+// observed by ContainerName, preserving any container recommendation in
+// observed whose container the recommender doesn't track (e.g. written by
+// another controller co-managing the object).
+func mergeRecommendations(desired, observed *vpa_types.RecommendedPodResources) *vpa_types.RecommendedPodResources {
+	if desired == nil {
+		return observed
+	}
+	var observedRecs []vpa_types.RecommendedContainerResources
+	if observed != nil {
+		observedRecs = observed.ContainerRecommendations
+	}
+	desiredByContainer := make(map[string]vpa_types.RecommendedContainerResources, len(desired.ContainerRecommendations))
+	for _, cr := range desired.ContainerRecommendations {
+		desiredByContainer[cr.ContainerName] = cr
+	}
+	merged := make([]vpa_types.RecommendedContainerResources, 0, len(observedRecs)+len(desired.ContainerRecommendations))
+	seen := make(map[string]bool, len(desired.ContainerRecommendations))
+	for _, cr := range observedRecs {
+		if desiredCr, owned := desiredByContainer[cr.ContainerName]; owned {
+			merged = append(merged, desiredCr)
+			seen[cr.ContainerName] = true
+		} else {
+			merged = append(merged, cr)
+		}
+	}
+	for _, cr := range desired.ContainerRecommendations {
+		if !seen[cr.ContainerName] {
+			merged = append(merged, cr)
+		}
+	}
+	return &vpa_types.RecommendedPodResources{ContainerRecommendations: merged}
+}
+
+// recommendationChangeThreshold is the fraction a container's CPU or memory
+// target must move by, relative to its previous value, before it is
+// considered significant enough to warrant an event.
+const recommendationChangeThreshold = 0.25
+
+// significantChange returns whether newQuantity differs from oldQuantity by
+// more than recommendationChangeThreshold, and a human-readable description
+// of the change.
+func significantChange(containerName string, resourceName core.ResourceName, oldQuantity, newQuantity resource.Quantity) (bool, string) {
+	oldValue := oldQuantity.AsApproximateFloat64()
+	newValue := newQuantity.AsApproximateFloat64()
+	if oldValue == 0 {
+		return false, ""
+	}
+	change := (newValue - oldValue) / oldValue
+	if change > recommendationChangeThreshold || change < -recommendationChangeThreshold {
+		return true, fmt.Sprintf("%s target for container %s: %s -> %s", resourceName, containerName, oldQuantity.String(), newQuantity.String())
+	}
+	return false, ""
+}
+
+// recordRecommendationChangeEvents emits a Normal event for every container
+// whose CPU or memory target moved by more than recommendationChangeThreshold
+// between observed and desired.
+func recordRecommendationChangeEvents(eventRecorder record.EventRecorder, vpaObj runtime.Object, observed, desired *vpa_types.RecommendedPodResources) {
+	if eventRecorder == nil || observed == nil || desired == nil {
+		return
+	}
+	observedByContainer := make(map[string]vpa_types.RecommendedContainerResources, len(observed.ContainerRecommendations))
+	for _, cr := range observed.ContainerRecommendations {
+		observedByContainer[cr.ContainerName] = cr
+	}
+	for _, desiredCr := range desired.ContainerRecommendations {
+		observedCr, found := observedByContainer[desiredCr.ContainerName]
+		if !found {
+			continue
+		}
+		for _, resourceName := range []core.ResourceName{core.ResourceCPU, core.ResourceMemory} {
+			oldQuantity, oldOk := observedCr.Target[resourceName]
+			newQuantity, newOk := desiredCr.Target[resourceName]
+			if !oldOk || !newOk {
+				continue
+			}
+			if changed, message := significantChange(desiredCr.ContainerName, resourceName, oldQuantity, newQuantity); changed {
+				eventRecorder.Event(vpaObj, core.EventTypeNormal, "RecommendationChanged", message)
+			}
+		}
+	}
+}
+
+// recordConditionTransitionEvents emits an event for every condition in
+// desired whose Status differs from its counterpart in observed (including
+// conditions with no counterpart at all), using the new condition's own
+// Reason/Message. Conditions indicating a degraded state (e.g. LowConfidence
+// becoming true) are reported as Warning events, all others as Normal.
+func recordConditionTransitionEvents(eventRecorder record.EventRecorder, vpaObj runtime.Object, observed, desired []vpa_types.VerticalPodAutoscalerCondition) {
+	if eventRecorder == nil {
+		return
+	}
+	observedByType := make(map[vpa_types.VerticalPodAutoscalerConditionType]vpa_types.VerticalPodAutoscalerCondition, len(observed))
+	for _, cond := range observed {
+		observedByType[cond.Type] = cond
+	}
+	for _, desiredCond := range desired {
+		observedCond, found := observedByType[desiredCond.Type]
+		if found && observedCond.Status == desiredCond.Status {
+			continue
+		}
+		eventType := core.EventTypeNormal
+		switch {
+		case desiredCond.Type == vpa_types.LowConfidence && desiredCond.Status == core.ConditionTrue:
+			eventType = core.EventTypeWarning
+		case desiredCond.Type == vpa_types.RecommendationProvided && desiredCond.Status == core.ConditionFalse:
+			eventType = core.EventTypeWarning
+		}
+		eventRecorder.Eventf(vpaObj, eventType, string(desiredCond.Type)+"Changed", "%s: %s", desiredCond.Reason, desiredCond.Message)
+	}
+}
+
+// statusPatch is the JSON merge-patch body sent to the API server. Only the
+// fields the recommender owns are included, and both the container
+// recommendations and the conditions are merged with whatever the live
+// object already carries, so other controllers writing elsewhere on the
+// object (or their own container recommendations/conditions) are left
+// untouched.
+type statusPatch struct {
+	Status statusPatchBody `json:"status"`
+}
+
+type statusPatchBody struct {
+	Recommendation *vpa_types.RecommendedPodResources         `json:"recommendation"`
+	Conditions     []vpa_types.VerticalPodAutoscalerCondition `json:"conditions"`
+}
+
+// UpdateVpaStatusIfNeeded patches the status field of the VPA API object if
+// the recommendation or conditions carried by the in-memory model differ
+// from what is stored in the API server. It returns the updated object, or
+// nil (and a nil error) if no write was necessary. The patch only touches the
+// recommendation and the conditions the recommender owns: container
+// recommendations and conditions are each merged by name/type with whatever
+// the live object already carries, leaving any container recommendation or
+// condition another controller sharing the object may have written intact,
+// and retries conflicts with an exponential backoff. If eventRecorder is
+// non-nil, a Normal or Warning event is emitted for every container whose
+// CPU/memory target moved by more than recommendationChangeThreshold, and for
+// every condition that transitioned.
+func UpdateVpaStatusIfNeeded(vpaClient vpa_api.VerticalPodAutoscalerInterface, eventRecorder record.EventRecorder, vpa *model.Vpa,
+	observedStatus *vpa_types.VerticalPodAutoscalerStatus) (result *vpa_types.VerticalPodAutoscaler, err error) {
+	newStatus := &vpa_types.VerticalPodAutoscalerStatus{
+		Conditions:     vpa.Conditions.AsList(),
+		Recommendation: vpa.Recommendation,
+	}
+
+	metrics_status.ObserveVpaStatus(vpa.ID.Namespace, vpa.ID.VpaName, newStatus)
+	observeContainerPolicies(vpa)
+
+	if vpaStatusUpToDate(newStatus, observedStatus) {
+		return nil, nil
+	}
+
+	var observedConditions []vpa_types.VerticalPodAutoscalerCondition
+	var observedRecommendation *vpa_types.RecommendedPodResources
+	if observedStatus != nil {
+		observedConditions = observedStatus.Conditions
+		observedRecommendation = observedStatus.Recommendation
+	}
+	patchBody, err := json.Marshal(statusPatch{
+		Status: statusPatchBody{
+			Recommendation: mergeRecommendations(newStatus.Recommendation, observedRecommendation),
+			Conditions:     mergeConditions(newStatus.Conditions, observedConditions),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	klog.V(4).InfoS("Patching VPA status", "vpa", klog.KRef(vpa.ID.Namespace, vpa.ID.VpaName))
+	err = retry.OnError(retry.DefaultBackoff, apierrors.IsConflict, func() error {
+		result, err = vpaClient.Patch(context.TODO(), vpa.ID.VpaName, types.MergePatchType, patchBody,
+			meta.PatchOptions{FieldManager: fieldManager}, "status")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	vpaRef := &vpa_types.VerticalPodAutoscaler{
+		ObjectMeta: meta.ObjectMeta{Name: vpa.ID.VpaName, Namespace: vpa.ID.Namespace, UID: result.UID},
+	}
+	recordRecommendationChangeEvents(eventRecorder, vpaRef, observedRecommendation, newStatus.Recommendation)
+	recordConditionTransitionEvents(eventRecorder, vpaRef, observedConditions, newStatus.Conditions)
+
+	return result, nil
+}
@@ -17,15 +17,24 @@ limitations under the License.
 package api
 
 import (
+	"encoding/json"
 	"flag"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
 	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
 	vpa_types "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/apis/autoscaling.k8s.io/v1beta2"
 	vpa_fake "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/client/clientset/versioned/fake"
 	"k8s.io/autoscaler/vertical-pod-autoscaler/pkg/recommender/model"
@@ -61,10 +70,11 @@ func TestUpdateVpaIfNeeded(t *testing.T) {
 	observedVpaBuilder := test.VerticalPodAutoscaler().WithName("vpa").WithNamespace("test").WithContainer(containerName)
 	modelVpa.Recommendation = recommendation
 	testCases := []struct {
-		caseName       string
-		vpa            *model.Vpa
-		observedStatus *vpa_types.VerticalPodAutoscalerStatus
-		expectedUpdate bool
+		caseName             string
+		vpa                  *model.Vpa
+		observedStatus       *vpa_types.VerticalPodAutoscalerStatus
+		expectedUpdate       bool
+		expectedEventReasons []string
 	}{
 		{
 			caseName: "Doesn't update if no changes.",
@@ -77,38 +87,175 @@ func TestUpdateVpaIfNeeded(t *testing.T) {
 			vpa:      modelVpa,
 			observedStatus: &observedVpaBuilder.WithTarget("10", "200").
 				AppendCondition(vpa_types.RecommendationProvided, core.ConditionTrue, "reason", "msg", anytime).Get().Status,
-			expectedUpdate: true,
+			expectedUpdate:       true,
+			expectedEventReasons: []string{"RecommendationChanged"},
 		}, {
 			caseName: "Updates on condition change.",
 			vpa:      modelVpa,
 			observedStatus: &observedVpaBuilder.WithTarget("5", "200").
 				AppendCondition(vpa_types.RecommendationProvided, core.ConditionFalse, "reason", "msg", anytime).Get().Status,
-			expectedUpdate: true,
+			expectedUpdate:       true,
+			expectedEventReasons: []string{"RecommendationProvidedChanged"},
 		}, {
-			caseName: "Updates on condition added.",
+			caseName: "Doesn't update if observed condition set is a strict superset.",
 			vpa:      modelVpa,
 			observedStatus: &observedVpaBuilder.WithTarget("5", "200").
 				AppendCondition(vpa_types.RecommendationProvided, core.ConditionTrue, "reason", "msg", anytime).
 				AppendCondition(vpa_types.LowConfidence, core.ConditionTrue, "reason", "msg", anytime).Get().Status,
+			expectedUpdate: false,
+		}, {
+			caseName: "Doesn't update if observed has an additional container recommendation.",
+			vpa:      modelVpa,
+			observedStatus: func() *vpa_types.VerticalPodAutoscalerStatus {
+				status := observedVpaBuilder.WithTarget("5", "200").
+					AppendCondition(vpa_types.RecommendationProvided, core.ConditionTrue, "reason", "msg", anytime).Get().Status
+				status.Recommendation.ContainerRecommendations = append(status.Recommendation.ContainerRecommendations,
+					test.Recommendation().WithContainer("container2").WithTarget("1", "100").Get().ContainerRecommendations...)
+				return &status
+			}(),
+			expectedUpdate: false,
+		}, {
+			caseName: "Updates if model adds a new container recommendation.",
+			vpa: func() *model.Vpa {
+				vpaWithExtraContainer := model.NewVpa(model.VpaID{VpaName: "vpa", Namespace: "test"}, nil, time.Now())
+				vpaWithExtraContainer.Conditions = modelVpa.Conditions
+				vpaWithExtraContainer.Recommendation = test.Recommendation().
+					WithContainer(containerName).WithTarget("5", "200").Get()
+				vpaWithExtraContainer.Recommendation.ContainerRecommendations = append(vpaWithExtraContainer.Recommendation.ContainerRecommendations,
+					test.Recommendation().WithContainer("container2").WithTarget("1", "100").Get().ContainerRecommendations...)
+				return vpaWithExtraContainer
+			}(),
+			observedStatus: &observedVpaBuilder.WithTarget("5", "200").
+				AppendCondition(vpa_types.RecommendationProvided, core.ConditionTrue, "reason", "msg", anytime).Get().Status,
 			expectedUpdate: true,
+		}, {
+			caseName: "Emits an event on a large CPU bump.",
+			vpa:      modelVpa,
+			observedStatus: &observedVpaBuilder.WithTarget("1", "200").
+				AppendCondition(vpa_types.RecommendationProvided, core.ConditionTrue, "reason", "msg", anytime).Get().Status,
+			expectedUpdate:       true,
+			expectedEventReasons: []string{"RecommendationChanged"},
+		}, {
+			caseName: "Emits an event when LowConfidence is added.",
+			vpa: func() *model.Vpa {
+				vpaWithLowConfidence := model.NewVpa(model.VpaID{VpaName: "vpa", Namespace: "test"}, nil, time.Now())
+				// Copy the conditions so that modelVpa, shared by the other cases, stays unchanged.
+				for conditionType, cond := range modelVpa.Conditions {
+					vpaWithLowConfidence.Conditions[conditionType] = cond
+				}
+				vpaWithLowConfidence.Conditions.Set(vpa_types.LowConfidence, true, "reason", "msg")
+				vpaWithLowConfidence.Recommendation = modelVpa.Recommendation
+				return vpaWithLowConfidence
+			}(),
+			observedStatus: &observedVpaBuilder.WithTarget("5", "200").
+				AppendCondition(vpa_types.RecommendationProvided, core.ConditionTrue, "reason", "msg", anytime).Get().Status,
+			expectedUpdate:       true,
+			expectedEventReasons: []string{"LowConfidenceChanged"},
 		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.caseName, func(t *testing.T) {
-			fakeClient := vpa_fake.NewSimpleClientset()
+			observedVpa := observedVpaBuilder.Get()
+			observedVpa.Status = *tc.observedStatus
+			fakeClient := vpa_fake.NewSimpleClientset(observedVpa)
+			fakeRecorder := record.NewFakeRecorder(10)
 			_, err := UpdateVpaStatusIfNeeded(fakeClient.AutoscalingV1beta2().VerticalPodAutoscalers(tc.vpa.ID.Namespace),
-				tc.vpa, tc.observedStatus)
+				fakeRecorder, tc.vpa, tc.observedStatus)
 			assert.NoError(t, err, "Unexpected error occurred.")
 			actions := fakeClient.Actions()
 			if tc.expectedUpdate {
 				assert.Equal(t, 1, len(actions), "Unexpected number of actions")
+				_, isPatch := actions[0].(clienttesting.PatchAction)
+				assert.True(t, isPatch, "Expected a patch action, got %T", actions[0])
 			} else {
 				assert.Equal(t, 0, len(actions), "Unexpected number of actions")
 			}
+			close(fakeRecorder.Events)
+			var gotReasons []string
+			for event := range fakeRecorder.Events {
+				parts := strings.SplitN(event, " ", 3)
+				if len(parts) == 3 {
+					gotReasons = append(gotReasons, parts[1])
+				}
+			}
+			assert.Equal(t, tc.expectedEventReasons, gotReasons)
 		})
 	}
 }
 
+func TestUpdateVpaStatusIfNeededPreservesUnownedConditions(t *testing.T) {
+	modelVpa := model.NewVpa(model.VpaID{VpaName: "vpa", Namespace: "test"}, nil, time.Now())
+	modelVpa.Conditions.Set(vpa_types.RecommendationProvided, true, "reason", "msg")
+	modelVpa.Recommendation = test.Recommendation().WithContainer(containerName).WithTarget("10", "200").Get()
+
+	observedStatus := &test.VerticalPodAutoscaler().WithName("vpa").WithNamespace("test").WithContainer(containerName).
+		WithTarget("5", "200").
+		AppendCondition(vpa_types.RecommendationProvided, core.ConditionFalse, "old-reason", "old-msg", anytime).
+		AppendCondition("ExternallyManaged", core.ConditionTrue, "unrelated", "owned by another controller", anytime).
+		Get().Status
+
+	existingVpa := test.VerticalPodAutoscaler().WithName("vpa").WithNamespace("test").WithContainer(containerName).Get()
+	existingVpa.Status = *observedStatus
+	fakeClient := vpa_fake.NewSimpleClientset(existingVpa)
+	_, err := UpdateVpaStatusIfNeeded(fakeClient.AutoscalingV1beta2().VerticalPodAutoscalers(modelVpa.ID.Namespace),
+		nil, modelVpa, observedStatus)
+	assert.NoError(t, err)
+
+	actions := fakeClient.Actions()
+	assert.Equal(t, 1, len(actions))
+	patchAction, ok := actions[0].(clienttesting.PatchAction)
+	assert.True(t, ok)
+
+	var patch statusPatch
+	assert.NoError(t, json.Unmarshal(patchAction.GetPatch(), &patch))
+
+	var externallyManaged, recommendationProvided *vpa_types.VerticalPodAutoscalerCondition
+	for i, cond := range patch.Status.Conditions {
+		switch cond.Type {
+		case "ExternallyManaged":
+			externallyManaged = &patch.Status.Conditions[i]
+		case vpa_types.RecommendationProvided:
+			recommendationProvided = &patch.Status.Conditions[i]
+		}
+	}
+
+	// The recommender's own condition is overwritten with the model's value...
+	assert.NotNil(t, recommendationProvided)
+	assert.Equal(t, core.ConditionTrue, recommendationProvided.Status)
+	assert.Equal(t, "reason", recommendationProvided.Reason)
+	// ...but the condition another controller owns is preserved verbatim.
+	assert.NotNil(t, externallyManaged)
+	assert.Equal(t, core.ConditionTrue, externallyManaged.Status)
+	assert.Equal(t, "unrelated", externallyManaged.Reason)
+}
+
+func TestUpdateVpaStatusIfNeededRetriesOnConflict(t *testing.T) {
+	modelVpa := model.NewVpa(model.VpaID{VpaName: "vpa", Namespace: "test"}, nil, time.Now())
+	modelVpa.Conditions.Set(vpa_types.RecommendationProvided, true, "reason", "msg")
+	modelVpa.Recommendation = test.Recommendation().WithContainer(containerName).WithTarget("10", "200").Get()
+
+	existingVpaBuilder := test.VerticalPodAutoscaler().WithName("vpa").WithNamespace("test").WithContainer(containerName).
+		WithTarget("5", "200").
+		AppendCondition(vpa_types.RecommendationProvided, core.ConditionTrue, "reason", "msg", anytime)
+	observedStatus := &existingVpaBuilder.Get().Status
+
+	fakeClient := vpa_fake.NewSimpleClientset(existingVpaBuilder.Get())
+	attempts := 0
+	fakeClient.PrependReactor("patch", "verticalpodautoscalers", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		attempts++
+		if attempts < 3 {
+			return true, nil, apierrors.NewConflict(
+				schema.GroupResource{Group: "autoscaling.k8s.io", Resource: "verticalpodautoscalers"}, "vpa", nil)
+		}
+		return false, nil, nil
+	})
+
+	_, err := UpdateVpaStatusIfNeeded(fakeClient.AutoscalingV1beta2().VerticalPodAutoscalers(modelVpa.ID.Namespace),
+		nil, modelVpa, observedStatus)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts, "Expected the patch to be retried until it succeeded")
+}
+
 func TestPodMatchesVPA(t *testing.T) {
 	type testCase struct {
 		pod             *core.Pod
@@ -156,10 +303,86 @@ func TestGetControllingVPAForPod(t *testing.T) {
 		{vpaB, parseLabelSelector("app = testingApp")},
 		{vpaA, parseLabelSelector("app = testingApp")},
 		{nonMatchingVPA, parseLabelSelector("app = other")},
-	})
+	}, nil)
 	assert.Equal(t, vpaA, chosen.Vpa)
 }
 
+// fakeOwnerResolver is a test OwnerResolver that always resolves to the same
+// owner chain, regardless of which pod is asked about.
+type fakeOwnerResolver struct {
+	chain []ControllerRef
+}
+
+func (r fakeOwnerResolver) GetOwnerChain(pod *core.Pod) []ControllerRef {
+	return r.chain
+}
+
+func TestGetControllingVPAForPodPrefersMatchingTargetRef(t *testing.T) {
+	pod := test.Pod().WithName("test-pod").AddContainer(test.BuildTestContainer(containerName, "1", "100M")).Get()
+	pod.Labels = map[string]string{"app": "testingApp"}
+	resolver := fakeOwnerResolver{chain: []ControllerRef{
+		{GroupKind: schema.GroupKind{Group: "apps", Kind: "StatefulSet"}, Name: "my-statefulset"},
+	}}
+
+	vpaBuilder := test.VerticalPodAutoscaler().
+		WithContainer(containerName).
+		WithTarget("2", "200M").
+		WithMinAllowed("1", "100M").
+		WithMaxAllowed("3", "1G")
+
+	// Newer, but targets the pod's actual owning StatefulSet directly.
+	statefulSetVpa := vpaBuilder.WithCreationTimestamp(time.Unix(10, 0)).Get()
+	statefulSetVpa.Spec.TargetRef = &autoscalingv1.CrossVersionObjectReference{
+		APIVersion: "apps/v1", Kind: "StatefulSet", Name: "my-statefulset",
+	}
+
+	// Older, and matches the pod only by label selector (e.g. a Deployment-targeted VPA).
+	deploymentVpa := vpaBuilder.WithCreationTimestamp(time.Unix(5, 0)).Get()
+	deploymentVpa.Spec.TargetRef = &autoscalingv1.CrossVersionObjectReference{
+		APIVersion: "apps/v1", Kind: "Deployment", Name: "some-deployment",
+	}
+
+	chosen := GetControllingVPAForPod(pod, []*VpaWithSelector{
+		{deploymentVpa, parseLabelSelector("app = testingApp")},
+		{statefulSetVpa, parseLabelSelector("app = testingApp")},
+	}, resolver)
+	assert.Equal(t, statefulSetVpa, chosen.Vpa)
+}
+
+func TestGetControllingVPAForPodPrefersRootOwner(t *testing.T) {
+	pod := test.Pod().WithName("test-pod").AddContainer(test.BuildTestContainer(containerName, "1", "100M")).Get()
+	pod.Labels = map[string]string{"app": "testingApp"}
+	// The pod is owned by a ReplicaSet, which is in turn owned by a Deployment.
+	resolver := fakeOwnerResolver{chain: []ControllerRef{
+		{GroupKind: schema.GroupKind{Group: "apps", Kind: "ReplicaSet"}, Name: "my-replicaset"},
+		{GroupKind: schema.GroupKind{Group: "apps", Kind: "Deployment"}, Name: "my-deployment"},
+	}}
+
+	vpaBuilder := test.VerticalPodAutoscaler().
+		WithContainer(containerName).
+		WithTarget("2", "200M").
+		WithMinAllowed("1", "100M").
+		WithMaxAllowed("3", "1G")
+
+	// Older, but only targets the intermediate (non-root) ReplicaSet.
+	replicaSetVpa := vpaBuilder.WithCreationTimestamp(time.Unix(5, 0)).Get()
+	replicaSetVpa.Spec.TargetRef = &autoscalingv1.CrossVersionObjectReference{
+		APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "my-replicaset",
+	}
+
+	// Newer, and targets the root Deployment, as a real VPA would.
+	deploymentVpa := vpaBuilder.WithCreationTimestamp(time.Unix(10, 0)).Get()
+	deploymentVpa.Spec.TargetRef = &autoscalingv1.CrossVersionObjectReference{
+		APIVersion: "apps/v1", Kind: "Deployment", Name: "my-deployment",
+	}
+
+	chosen := GetControllingVPAForPod(pod, []*VpaWithSelector{
+		{replicaSetVpa, parseLabelSelector("app = testingApp")},
+		{deploymentVpa, parseLabelSelector("app = testingApp")},
+	}, resolver)
+	assert.Equal(t, deploymentVpa, chosen.Vpa)
+}
+
 func TestGetContainerResourcePolicy(t *testing.T) {
 	containerPolicy1 := vpa_types.ContainerResourcePolicy{
 		ContainerName: "container1",
@@ -198,3 +421,44 @@ func TestGetContainerResourcePolicy(t *testing.T) {
 	assert.Equal(t, &containerPolicy2, GetContainerResourcePolicy("container2", &policy))
 	assert.Equal(t, &defaultPolicy, GetContainerResourcePolicy("container3", &policy))
 }
+
+func TestResolveEffectiveContainerPolicy(t *testing.T) {
+	wildcardPolicy := vpa_types.ContainerResourcePolicy{
+		ContainerName: "*",
+		MinAllowed: core.ResourceList{
+			core.ResourceMemory: *resource.NewScaledQuantity(100, 1),
+		},
+		Mode: vpaModePtr(vpa_types.ContainerScalingModeAuto),
+	}
+	container1Policy := vpa_types.ContainerResourcePolicy{
+		ContainerName: "container1",
+		MinAllowed: core.ResourceList{
+			core.ResourceCPU: *resource.NewScaledQuantity(10, 1),
+		},
+	}
+	policy := vpa_types.PodResourcePolicy{
+		ContainerPolicies: []vpa_types.ContainerResourcePolicy{container1Policy, wildcardPolicy},
+	}
+
+	// Named policy sets MinAllowed cpu, wildcard sets MinAllowed memory: result has both.
+	merged := ResolveEffectiveContainerPolicy("container1", &policy)
+	assert.Equal(t, *resource.NewScaledQuantity(10, 1), merged.MinAllowed[core.ResourceCPU])
+	assert.Equal(t, *resource.NewScaledQuantity(100, 1), merged.MinAllowed[core.ResourceMemory])
+
+	// Named policy has no Mode of its own: it inherits the wildcard's.
+	assert.Equal(t, vpaModePtr(vpa_types.ContainerScalingModeAuto), merged.Mode)
+
+	// A container with no policy of its own gets the wildcard policy verbatim (renamed).
+	onlyWildcard := ResolveEffectiveContainerPolicy("container2", &policy)
+	assert.Equal(t, "container2", onlyWildcard.ContainerName)
+	assert.Equal(t, wildcardPolicy.MinAllowed, onlyWildcard.MinAllowed)
+
+	// No wildcard present at all: behaves like a plain named lookup.
+	noWildcardPolicy := vpa_types.PodResourcePolicy{ContainerPolicies: []vpa_types.ContainerResourcePolicy{container1Policy}}
+	assert.Equal(t, &container1Policy, ResolveEffectiveContainerPolicy("container1", &noWildcardPolicy))
+	assert.Nil(t, ResolveEffectiveContainerPolicy("container2", &noWildcardPolicy))
+}
+
+func vpaModePtr(m vpa_types.ContainerScalingMode) *vpa_types.ContainerScalingMode {
+	return &m
+}